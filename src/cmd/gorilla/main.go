@@ -0,0 +1,106 @@
+// Command gorilla compiles and runs gorilla-lang source files, and can
+// persist the compiled bytecode to disk so it can be run again without
+// recompiling.
+package main
+
+import (
+	"compiler"
+	"flag"
+	"fmt"
+	"object"
+	"os"
+	"parser"
+	"strings"
+	"token"
+	"vm"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(1)
+	}
+
+	switch os.Args[1] {
+	case "compile":
+		runCompile(os.Args[2:])
+	case "run":
+		runRun(os.Args[2:])
+	default:
+		usage()
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: gorilla compile <file.gor> -o <file.gbc>")
+	fmt.Fprintln(os.Stderr, "       gorilla run <file.gbc>")
+}
+
+func runCompile(args []string) {
+	fs := flag.NewFlagSet("compile", flag.ExitOnError)
+	out := fs.String("o", "", "output bytecode file")
+	// flag stops at the first non-flag argument, so move a leading input
+	// file to the end to accept "-o" after it as well as before it.
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		args = append(append([]string{}, args[1:]...), args[0])
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || *out == "" {
+		usage()
+		os.Exit(1)
+	}
+
+	src, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fatalf("read %s: %s", fs.Arg(0), err)
+	}
+
+	p := parser.New(fs.Arg(0), string(src))
+	program, errs := p.ParseProgram()
+	if err := errs.Err(); err != nil {
+		fatalf("parse %s: %s", fs.Arg(0), err)
+	}
+
+	c := compiler.New()
+	if err := c.Compile(program); err != nil {
+		fatalf("compile %s: %s", fs.Arg(0), err)
+	}
+
+	data, err := c.Bytecode().MarshalBinary()
+	if err != nil {
+		fatalf("marshal bytecode: %s", err)
+	}
+
+	if err := os.WriteFile(*out, data, 0644); err != nil {
+		fatalf("write %s: %s", *out, err)
+	}
+}
+
+func runRun(args []string) {
+	if len(args) != 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		fatalf("read %s: %s", args[0], err)
+	}
+
+	var bytecode compiler.Bytecode
+	if err := bytecode.UnmarshalBinary(data); err != nil {
+		fatalf("unmarshal %s: %s", args[0], err)
+	}
+
+	machine := vm.NewWithGlobals(&bytecode, make([]object.Object, vm.GlobalSize))
+	if err := machine.Run(); err != nil {
+		fatalf("run %s: %s", args[0], err)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,340 @@
+package compiler
+
+import (
+	"bytes"
+	"code"
+	"encoding/binary"
+	"fmt"
+	"object"
+)
+
+// bytecodeMagic identifies a file produced by Bytecode.MarshalBinary so
+// UnmarshalBinary can reject garbage input up front instead of failing
+// partway through decoding.
+const bytecodeMagic = "GRLA"
+const bytecodeVersion byte = 1
+
+// Constant pool tags: each constant is written as a tag byte followed by
+// its type-specific encoding, so UnmarshalBinary can reconstruct the
+// concrete object.Object without any external type information.
+const (
+	constTagInteger byte = iota + 1
+	constTagString
+	constTagBoolean
+	constTagCompiledFunction
+	constTagNull
+	constTagArray
+	constTagHash
+	constTagClosure
+)
+
+// MarshalBinary encodes b into a self-describing blob: a "GRLA" magic
+// header, a version byte, the length-prefixed instruction stream, and a
+// typed constant pool. The result can be written to disk and later
+// decoded by UnmarshalBinary, possibly in another process, without
+// recompiling the source.
+func (b *Bytecode) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	buf.WriteString(bytecodeMagic)
+	buf.WriteByte(bytecodeVersion)
+
+	if err := writeChunk(buf, b.Instructions); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.LittleEndian, uint32(len(b.Constants))); err != nil {
+		return nil, err
+	}
+
+	for _, constant := range b.Constants {
+		if err := writeConstant(buf, constant); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a blob produced by MarshalBinary into b,
+// replacing its Instructions and Constants. It returns an error if the
+// magic header or version byte don't match.
+func (b *Bytecode) UnmarshalBinary(data []byte) error {
+	buf := bytes.NewReader(data)
+
+	magic := make([]byte, len(bytecodeMagic))
+	if _, err := readFull(buf, magic); err != nil {
+		return err
+	}
+	if string(magic) != bytecodeMagic {
+		return fmt.Errorf("not a gorilla bytecode file: bad magic %q", magic)
+	}
+
+	version, err := buf.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != bytecodeVersion {
+		return fmt.Errorf("unsupported bytecode version %d", version)
+	}
+
+	instructions, err := readChunk(buf)
+	if err != nil {
+		return err
+	}
+	b.Instructions = code.Instructions(instructions)
+
+	var numConstants uint32
+	if err := binary.Read(buf, binary.LittleEndian, &numConstants); err != nil {
+		return err
+	}
+
+	constants := make([]object.Object, numConstants)
+	for i := range constants {
+		constant, err := readConstant(buf)
+		if err != nil {
+			return err
+		}
+		constants[i] = constant
+	}
+	b.Constants = constants
+
+	return nil
+}
+
+func writeChunk(buf *bytes.Buffer, data []byte) error {
+	if err := binary.Write(buf, binary.LittleEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := buf.Write(data)
+	return err
+}
+
+func readChunk(buf *bytes.Reader) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(buf, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, n)
+	if _, err := readFull(buf, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func readFull(buf *bytes.Reader, data []byte) (int, error) {
+	total := 0
+	for total < len(data) {
+		n, err := buf.Read(data[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func writeConstant(buf *bytes.Buffer, constant object.Object) error {
+	switch c := constant.(type) {
+	case nil:
+		buf.WriteByte(constTagNull)
+		return nil
+
+	case *object.Null:
+		buf.WriteByte(constTagNull)
+		return nil
+
+	case *object.Integer:
+		buf.WriteByte(constTagInteger)
+		return binary.Write(buf, binary.LittleEndian, c.Value)
+
+	case *object.String:
+		buf.WriteByte(constTagString)
+		return writeChunk(buf, []byte(c.Value))
+
+	case *object.Boolean:
+		buf.WriteByte(constTagBoolean)
+		if c.Value {
+			return buf.WriteByte(1)
+		}
+		return buf.WriteByte(0)
+
+	case *object.CompiledFunction:
+		buf.WriteByte(constTagCompiledFunction)
+		if err := writeChunk(buf, c.Instructions); err != nil {
+			return err
+		}
+		if err := binary.Write(buf, binary.LittleEndian, int64(c.NumLocals)); err != nil {
+			return err
+		}
+		return binary.Write(buf, binary.LittleEndian, int64(c.NumParameters))
+
+	case *object.Array:
+		buf.WriteByte(constTagArray)
+		if err := binary.Write(buf, binary.LittleEndian, uint32(len(c.Elements))); err != nil {
+			return err
+		}
+		for _, element := range c.Elements {
+			if err := writeConstant(buf, element); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case *object.Hash:
+		buf.WriteByte(constTagHash)
+		if err := binary.Write(buf, binary.LittleEndian, uint32(len(c.Pairs))); err != nil {
+			return err
+		}
+		for _, pair := range c.Pairs {
+			if err := writeConstant(buf, pair.Key); err != nil {
+				return err
+			}
+			if err := writeConstant(buf, pair.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case *object.Closure:
+		buf.WriteByte(constTagClosure)
+		if err := writeConstant(buf, c.Fn); err != nil {
+			return err
+		}
+		if err := binary.Write(buf, binary.LittleEndian, uint32(len(c.Free))); err != nil {
+			return err
+		}
+		for _, free := range c.Free {
+			if err := writeConstant(buf, free); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("cannot marshal constant of type %T", constant)
+	}
+}
+
+func readConstant(buf *bytes.Reader) (object.Object, error) {
+	tag, err := buf.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tag {
+	case constTagInteger:
+		var value int64
+		if err := binary.Read(buf, binary.LittleEndian, &value); err != nil {
+			return nil, err
+		}
+		return &object.Integer{Value: value}, nil
+
+	case constTagString:
+		data, err := readChunk(buf)
+		if err != nil {
+			return nil, err
+		}
+		return &object.String{Value: string(data)}, nil
+
+	case constTagBoolean:
+		value, err := buf.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		return &object.Boolean{Value: value == 1}, nil
+
+	case constTagCompiledFunction:
+		instructions, err := readChunk(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		var numLocals, numParameters int64
+		if err := binary.Read(buf, binary.LittleEndian, &numLocals); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(buf, binary.LittleEndian, &numParameters); err != nil {
+			return nil, err
+		}
+
+		return &object.CompiledFunction{
+			Instructions:  code.Instructions(instructions),
+			NumLocals:     int(numLocals),
+			NumParameters: int(numParameters),
+		}, nil
+
+	case constTagNull:
+		return &object.Null{}, nil
+
+	case constTagArray:
+		var numElements uint32
+		if err := binary.Read(buf, binary.LittleEndian, &numElements); err != nil {
+			return nil, err
+		}
+
+		elements := make([]object.Object, numElements)
+		for i := range elements {
+			element, err := readConstant(buf)
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = element
+		}
+		return &object.Array{Elements: elements}, nil
+
+	case constTagHash:
+		var numPairs uint32
+		if err := binary.Read(buf, binary.LittleEndian, &numPairs); err != nil {
+			return nil, err
+		}
+
+		pairs := make(map[object.HashKey]object.HashPair, numPairs)
+		for i := uint32(0); i < numPairs; i++ {
+			key, err := readConstant(buf)
+			if err != nil {
+				return nil, err
+			}
+			value, err := readConstant(buf)
+			if err != nil {
+				return nil, err
+			}
+
+			hashKey, ok := key.(object.Hashable)
+			if !ok {
+				return nil, fmt.Errorf("unusable as hash key: %T", key)
+			}
+			pairs[hashKey.HashKey()] = object.HashPair{Key: key, Value: value}
+		}
+		return &object.Hash{Pairs: pairs}, nil
+
+	case constTagClosure:
+		fn, err := readConstant(buf)
+		if err != nil {
+			return nil, err
+		}
+		compiledFn, ok := fn.(*object.CompiledFunction)
+		if !ok {
+			return nil, fmt.Errorf("closure function is not a compiled function: %T", fn)
+		}
+
+		var numFree uint32
+		if err := binary.Read(buf, binary.LittleEndian, &numFree); err != nil {
+			return nil, err
+		}
+
+		free := make([]object.Object, numFree)
+		for i := range free {
+			freeVar, err := readConstant(buf)
+			if err != nil {
+				return nil, err
+			}
+			free[i] = freeVar
+		}
+		return &object.Closure{Fn: compiledFn, Free: free}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown constant tag %d", tag)
+	}
+}
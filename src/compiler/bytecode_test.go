@@ -0,0 +1,142 @@
+package compiler
+
+import (
+	"code"
+	"object"
+	"parser"
+	"testing"
+	"vm"
+)
+
+func TestBytecodeMarshalUnmarshalRoundTrip(t *testing.T) {
+	original := &Bytecode{
+		Instructions: code.Make(code.OpAdd),
+		Constants: []object.Object{
+			&object.Integer{Value: 42},
+			&object.String{Value: "gorilla"},
+			&object.Boolean{Value: true},
+			&object.CompiledFunction{
+				Instructions:  code.Make(code.OpConstant, 0),
+				NumLocals:     1,
+				NumParameters: 2,
+			},
+		},
+	}
+
+	data, err := original.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %s", err)
+	}
+
+	var decoded Bytecode
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary failed: %s", err)
+	}
+
+	if string(decoded.Instructions) != string(original.Instructions) {
+		t.Errorf("instructions not equal. want=%v, got=%v", original.Instructions, decoded.Instructions)
+	}
+
+	if len(decoded.Constants) != len(original.Constants) {
+		t.Fatalf("constants length not equal. want=%d, got=%d", len(original.Constants), len(decoded.Constants))
+	}
+
+	for i, want := range original.Constants {
+		got := decoded.Constants[i]
+		if got.Inspect() != want.Inspect() {
+			t.Errorf("constant %d not equal. want=%s, got=%s", i, want.Inspect(), got.Inspect())
+		}
+	}
+}
+
+func TestSymbolTableMarshalUnmarshalRoundTrip(t *testing.T) {
+	original := NewSymbolTable()
+	original.Define("a")
+	original.Define("b")
+
+	data, err := original.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %s", err)
+	}
+
+	restored := NewSymbolTable()
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary failed: %s", err)
+	}
+
+	for _, name := range []string{"a", "b"} {
+		want, ok := original.Resolve(name)
+		if !ok {
+			t.Fatalf("original table missing %q", name)
+		}
+
+		got, ok := restored.Resolve(name)
+		if !ok {
+			t.Errorf("restored table missing %q", name)
+		}
+
+		if got != want {
+			t.Errorf("symbol %q not equal. want=%+v, got=%+v", name, want, got)
+		}
+	}
+}
+
+// TestCompiledProgramMarshalUnmarshalRoundTrip drives a handful of
+// representative programs through compile -> vm.Run and separately through
+// compile -> marshal -> unmarshal -> vm.Run, and checks both runs produce
+// the same result. This is what :save/:load and `gorilla compile`/`gorilla
+// run` rely on: the marshaled bytecode has to be runnable, not just decodable.
+func TestCompiledProgramMarshalUnmarshalRoundTrip(t *testing.T) {
+	tests := []struct {
+		input string
+	}{
+		{"1 + 2 * 3"},
+		{`"foo" + "bar"`},
+		{"1 == 2"},
+		{"if (1 > 2) { 10 } else { 20 }"},
+		{"let a = 5; let b = a; b"},
+		{"[1, 2, 3][1]"},
+		{`{"one": 1, "two": 2}["two"]`},
+		{"let add = fn(a, b) { a + b }; add(1, 2)"},
+		{"let newAdder = fn(a) { fn(b) { a + b } }; let addTwo = newAdder(2); addTwo(3)"},
+	}
+
+	for _, tt := range tests {
+		p := parser.New("<test>", tt.input)
+		program, errs := p.ParseProgram()
+		if err := errs.Err(); err != nil {
+			t.Fatalf("parse %q failed: %s", tt.input, err)
+		}
+
+		comp := New()
+		if err := comp.Compile(program); err != nil {
+			t.Fatalf("compile %q failed: %s", tt.input, err)
+		}
+
+		directMachine := vm.New(comp.Bytecode())
+		if err := directMachine.Run(); err != nil {
+			t.Fatalf("direct run %q failed: %s", tt.input, err)
+		}
+		want := directMachine.StackLastTop()
+
+		data, err := comp.Bytecode().MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary %q failed: %s", tt.input, err)
+		}
+
+		var decoded Bytecode
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("UnmarshalBinary %q failed: %s", tt.input, err)
+		}
+
+		decodedMachine := vm.New(&decoded)
+		if err := decodedMachine.Run(); err != nil {
+			t.Fatalf("decoded run %q failed: %s", tt.input, err)
+		}
+		got := decodedMachine.StackLastTop()
+
+		if got.Inspect() != want.Inspect() {
+			t.Errorf("%q: round-tripped result not equal. want=%s, got=%s", tt.input, want.Inspect(), got.Inspect())
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// NumDefinitions reports how many symbols have been defined in this table,
+// i.e. one past the highest index any symbol was assigned. A session saver
+// uses this to know how much of the globals slice is actually in use,
+// since the slice itself is preallocated to vm.GlobalSize.
+func (s *SymbolTable) NumDefinitions() int {
+	return s.numDefinitions
+}
+
+// MarshalBinary encodes the table's own symbols (not those of an Outer
+// table) as a count followed by repeated (name, scope, index) triples, so
+// a saved REPL session can be reloaded with every global still bound to
+// the index the earlier bytecode compiled it to.
+func (s *SymbolTable) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.LittleEndian, uint32(len(s.store))); err != nil {
+		return nil, err
+	}
+
+	for name, sym := range s.store {
+		if err := writeChunk(buf, []byte(name)); err != nil {
+			return nil, err
+		}
+		if err := writeChunk(buf, []byte(sym.Scope)); err != nil {
+			return nil, err
+		}
+		if err := binary.Write(buf, binary.LittleEndian, int64(sym.Index)); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a blob produced by MarshalBinary into s,
+// restoring every symbol at the index it was originally defined at.
+func (s *SymbolTable) UnmarshalBinary(data []byte) error {
+	buf := bytes.NewReader(data)
+
+	var count uint32
+	if err := binary.Read(buf, binary.LittleEndian, &count); err != nil {
+		return err
+	}
+
+	for i := uint32(0); i < count; i++ {
+		nameBytes, err := readChunk(buf)
+		if err != nil {
+			return err
+		}
+
+		scopeBytes, err := readChunk(buf)
+		if err != nil {
+			return err
+		}
+
+		var index int64
+		if err := binary.Read(buf, binary.LittleEndian, &index); err != nil {
+			return err
+		}
+
+		name := string(nameBytes)
+		s.store[name] = Symbol{Name: name, Scope: SymbolScope(scopeBytes), Index: int(index)}
+		if int(index)+1 > s.numDefinitions {
+			s.numDefinitions = int(index) + 1
+		}
+	}
+
+	return nil
+}
@@ -3,45 +3,154 @@ package parser
 import (
 	"ast"
 	"fmt"
+	"io"
 	"lexer"
+	"os"
+	"sort"
 	"strconv"
 	"token"
 )
 
+// Mode is a set of flags (or 0) that controls the behavior of the parser.
+type Mode uint
+
+// Only Trace changes how the parser behaves. The other flags are stored and
+// returned by (*Parser).Mode, but the parser never consults them.
+const (
+	Trace                Mode = 1 << iota // print a trace of parsed productions
+	DeclarationErrors                     // not consulted: redeclared identifiers are never reported
+	AllErrors                             // not consulted: every error is always reported
+	SkipObjectResolution                  // not consulted: identifiers are never resolved to objects
+)
+
 type (
 	prefixParseFn func() ast.Expression
 	infixParseFn  func(ast.Expression) ast.Expression
 )
 
-type ParserError struct {
-	errorToken token.Token
-	msg        string
-	pos        token.Position
+// Error is a single parsing problem found at a source position. ParseProgram
+// collects every Error it encounters into an ErrorList instead of stopping
+// at the first one.
+type Error struct {
+	Pos token.Position
+	Msg string
+}
+
+func (e Error) Error() string {
+	if e.Pos.Filename == "" {
+		return fmt.Sprintf("%d:%d: %s", e.Pos.Line, e.Pos.Column, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", e.Pos.Filename, e.Pos.Line, e.Pos.Column, e.Msg)
 }
 
-func (p ParserError) Error() string {
-	return fmt.Sprintf("%s at line: %d, column: %d", p.msg, p.pos.Line, p.pos.Column)
+// ErrorList is a sortable list of parsing errors. It implements the error
+// interface itself so it can be returned and checked anywhere a plain error
+// is expected.
+type ErrorList []*Error
+
+// Add appends a new error at pos to the list.
+func (el *ErrorList) Add(pos token.Position, msg string) {
+	*el = append(*el, &Error{Pos: pos, Msg: msg})
+}
+
+func (el ErrorList) Len() int      { return len(el) }
+func (el ErrorList) Swap(i, j int) { el[i], el[j] = el[j], el[i] }
+func (el ErrorList) Less(i, j int) bool {
+	if el[i].Pos.Line != el[j].Pos.Line {
+		return el[i].Pos.Line < el[j].Pos.Line
+	}
+	return el[i].Pos.Column < el[j].Pos.Column
 }
 
+// Sort orders the list by source position, in place.
+func (el ErrorList) Sort() {
+	sort.Sort(el)
+}
+
+// Error renders the first error in the list plus a count of how many more
+// there are, so a single-line summary is still useful.
+func (el ErrorList) Error() string {
+	switch len(el) {
+	case 0:
+		return "no errors"
+	case 1:
+		return el[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", el[0], len(el)-1)
+}
+
+// Err returns nil if the list is empty, and the list itself otherwise, so
+// callers can write `if err := errs.Err(); err != nil`.
+func (el ErrorList) Err() error {
+	if len(el) == 0 {
+		return nil
+	}
+	return el
+}
+
+// bailout is panicked when the parser can no longer make progress at all
+// (e.g. synchronization failed to advance past the same token repeatedly).
+// It is recovered in ParseProgram and never escapes to callers.
+type bailout struct{}
+
 type Parser struct {
 	lex         *lexer.Lexer
+	fset        *token.FileSet
 	initialized bool
 
-	tracing     bool
+	mode        Mode
+	traceOut    io.Writer
 	traceIndent int
 
 	currentToken token.Token
 	peekToken    token.Token
 
+	// syncPos and syncCount let syncStmt/syncDecl detect that a sync point
+	// failed to advance the parser (currentToken is stuck at the same
+	// source position, e.g. EOF) and force a bailout instead of looping
+	// forever.
+	syncPos   token.Pos
+	syncCount int
+
+	// blockDepth counts how many enclosing { } blocks the parser is
+	// currently inside. sync uses it to choose between syncStmt (stop at
+	// the block's closing RBRACE) and syncDecl (no enclosing brace to stop
+	// at, so don't treat RBRACE as a sync point) when recovering from an
+	// error.
+	blockDepth int
+
+	errors ErrorList
+
 	prefixFns map[token.TokenType]prefixParseFn
 	infixFns  map[token.TokenType]infixParseFn
 }
 
-func New(input string) *Parser {
-	handler := func(pos token.Position, msg string) {
-		panic(fmt.Sprintf("%s at line: %d, column: %d", msg, pos.Line, pos.Column))
-	}
-	p := Parser{lex: lexer.New(input, handler),
+// New creates a Parser for input with no mode flags set and tracing
+// disabled, registering input as filename in a fresh FileSet. Use
+// NewWithMode to share a FileSet across several parses (as the REPL
+// does) or to enable tracing.
+func New(filename, input string) *Parser {
+	return NewWithMode(token.NewFileSet(), filename, input, 0, os.Stdout)
+}
+
+// NewWithMode creates a Parser for input, registered as filename in fset,
+// with mode controlling optional behavior such as production tracing
+// (Trace). When Trace is set, every parse function writes a trace of the
+// productions it enters and leaves to traceOut; traceOut is ignored
+// otherwise and may be nil. Errors reported by the returned Parser carry
+// positions resolved through fset, so callers that parse multiple files
+// (or multiple REPL lines) should share one FileSet across those calls.
+func NewWithMode(fset *token.FileSet, filename, input string, mode Mode, traceOut io.Writer) *Parser {
+	file := fset.AddFile(filename, -1, len(input))
+
+	handler := func(pos token.Pos, msg string) {
+		position := fset.Position(pos)
+		panic(fmt.Sprintf("%s at %s:%d:%d", msg, position.Filename, position.Line, position.Column))
+	}
+	p := Parser{lex: lexer.New(file, handler),
+		fset:      fset,
+		mode:      mode,
+		traceOut:  traceOut,
 		prefixFns: make(map[token.TokenType]prefixParseFn),
 		infixFns:  make(map[token.TokenType]infixParseFn)}
 
@@ -75,6 +184,11 @@ func New(input string) *Parser {
 	return &p
 }
 
+// Mode returns the mode flags the Parser was constructed with.
+func (p *Parser) Mode() Mode {
+	return p.mode
+}
+
 func (p *Parser) registerPrefixParseFn(tokenType token.TokenType, prefixFn prefixParseFn) {
 	p.prefixFns[tokenType] = prefixFn
 }
@@ -89,6 +203,93 @@ func (p *Parser) nextToken() token.Token {
 	return p.currentToken
 }
 
+// errorf records a parsing error at pos, resolved through the Parser's
+// FileSet into a Filename/Line/Column, and lets the caller decide how to
+// recover; it never panics by itself.
+func (p *Parser) errorf(pos token.Pos, format string, args ...interface{}) {
+	p.errors.Add(p.fset.Position(pos), fmt.Sprintf(format, args...))
+}
+
+// declStart holds the token types syncDecl/syncStmt treat as the start of
+// a new top-level construct worth resuming at.
+var declStart = map[token.TokenType]bool{
+	token.LET:      true,
+	token.RETURN:   true,
+	token.FUNCTION: true,
+	token.IF:       true,
+}
+
+// advanceSync records progress made by syncStmt/syncDecl. Progress is
+// measured by currentToken's source position rather than how many
+// nextToken calls it took to get there: a caller can keep calling
+// nextToken while currentToken stays pinned at EOF, which would look like
+// progress by a call-count metric but isn't. If the parser is still stuck
+// at the same position after repeated attempts, it bails out rather than
+// risk an infinite loop on pathological input.
+func (p *Parser) advanceSync() {
+	if p.currentToken.Pos == p.syncPos {
+		p.syncCount++
+		if p.syncCount > 10 {
+			panic(bailout{})
+		}
+		return
+	}
+
+	p.syncPos = p.currentToken.Pos
+	p.syncCount = 0
+}
+
+// sync recovers from a parse error by skipping tokens until the parser can
+// resume, picking the right stopping set for the current nesting: syncStmt
+// inside a block, so it can stop at the block's own closing RBRACE, or
+// syncDecl at the top level, which has no enclosing brace to stop at.
+func (p *Parser) sync() {
+	if p.blockDepth > 0 {
+		p.syncStmt()
+	} else {
+		p.syncDecl()
+	}
+}
+
+// syncStmt advances currentToken past a broken statement inside a block,
+// stopping at the next SEMICOLON, RBRACE, or top-level keyword so parsing
+// of the rest of the block can continue.
+func (p *Parser) syncStmt() {
+	for {
+		switch p.currentToken.Type {
+		case token.SEMICOLON, token.RBRACE, token.EOF:
+			p.advanceSync()
+			return
+		default:
+			if declStart[p.currentToken.Type] {
+				p.advanceSync()
+				return
+			}
+		}
+
+		p.nextToken()
+	}
+}
+
+// syncDecl is syncStmt's top-level counterpart: it does not stop at RBRACE,
+// since top-level programs have no enclosing block to close.
+func (p *Parser) syncDecl() {
+	for {
+		switch p.currentToken.Type {
+		case token.SEMICOLON, token.EOF:
+			p.advanceSync()
+			return
+		default:
+			if declStart[p.currentToken.Type] {
+				p.advanceSync()
+				return
+			}
+		}
+
+		p.nextToken()
+	}
+}
+
 func (p *Parser) peekTokenPrecedence() int {
 	return p.peekToken.Precedence()
 }
@@ -100,27 +301,34 @@ func (p *Parser) currentTokenPrecedence() int {
 func (p *Parser) printTrace(a ...interface{}) {
 	const dots = ". . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . "
 	const n = len(dots)
-	pos := p.currentToken.Pos
-	fmt.Printf("%5d:%3d: ", pos.Line, pos.Column)
+	pos := p.fset.Position(p.currentToken.Pos)
+	fmt.Fprintf(p.traceOut, "%5d:%3d: ", pos.Line, pos.Column)
 	i := 2 * p.traceIndent
 	for i > n {
-		fmt.Print(dots)
+		fmt.Fprint(p.traceOut, dots)
 		i -= n
 	}
 	// i <= n
-	fmt.Print(dots[0:i])
-	fmt.Println(a...)
+	fmt.Fprint(p.traceOut, dots[0:i])
+	fmt.Fprintln(p.traceOut, a...)
 }
 
-func trace(p *Parser, msg string) *Parser {
+// trace reports entry into the production named msg when Trace mode is
+// set, and returns a function to be deferred that reports the matching
+// exit. When Trace is not set it is a no-op, so call sites can simply
+// write `defer p.trace("Name")()` unconditionally.
+func (p *Parser) trace(msg string) func() {
+	if p.mode&Trace == 0 {
+		return func() {}
+	}
+
 	p.printTrace(msg, "(")
 	p.traceIndent++
-	return p
-}
 
-func un(p *Parser) {
-	p.traceIndent--
-	p.printTrace(")")
+	return func() {
+		p.traceIndent--
+		p.printTrace(")")
+	}
 }
 
 func (p *Parser) parseStatement() ast.Statement {
@@ -139,9 +347,7 @@ func (p *Parser) parseStatement() ast.Statement {
 }
 
 func (p *Parser) parseLetStatement() *ast.LetStatement {
-	if p.tracing {
-		defer un(trace(p, "LetStatement"))
-	}
+	defer p.trace("LetStatement")()
 
 	letStatement := &ast.LetStatement{Token: p.currentToken}
 
@@ -169,9 +375,7 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 }
 
 func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
-	if p.tracing {
-		defer un(trace(p, "ReturnStatement"))
-	}
+	defer p.trace("ReturnStatement")()
 
 	retStatement := &ast.ReturnStatement{Token: p.currentToken}
 
@@ -191,9 +395,7 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 }
 
 func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
-	if p.tracing {
-		defer un(trace(p, "ExpressionStatement"))
-	}
+	defer p.trace("ExpressionStatement")()
 
 	express := &ast.ExpressionStatement{Token: p.currentToken}
 
@@ -213,13 +415,13 @@ func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
 比如 if 表达式开始解析的时候要保证 current token 指向 if，结束时保证 current token 指向 }
 */
 func (p *Parser) parseExpression(precedence int) ast.Expression {
-	if p.tracing {
-		defer un(trace(p, "Expression"))
-	}
+	defer p.trace("Expression")()
 
 	prefixFn := p.prefixFns[p.currentToken.Type]
 	if prefixFn == nil {
-		panic(ParserError{msg: fmt.Sprintf("can not parse token type %q", p.currentToken.Type), errorToken: p.currentToken})
+		p.errorf(p.currentToken.Pos, "can not parse token type %q", p.currentToken.Type)
+		p.sync()
+		return nil
 	}
 
 	left := prefixFn()
@@ -259,9 +461,13 @@ func (p *Parser) assertCurrentTokenType(expect token.TokenType) {
 	p.assertTokenType(expect, p.currentToken)
 }
 
+// assertTokenType advances past actual if it matches expect. Otherwise it
+// records an error and synchronizes instead of panicking, so the rest of
+// the program still gets parsed.
 func (p *Parser) assertTokenType(expect token.TokenType, actual token.Token) {
 	if actual.Type != expect {
-		panic(ParserError{msg: fmt.Sprintf("expectd token type is %q, got %q", expect, actual.Type), errorToken: actual})
+		p.errorf(actual.Pos, "expectd token type is %q, got %q", expect, actual.Type)
+		p.sync()
 	} else {
 		p.nextToken()
 	}
@@ -278,7 +484,8 @@ func (p *Parser) parseIdentifier() ast.Expression {
 func (p *Parser) parseInteger() ast.Expression {
 	value, err := strconv.ParseInt(p.currentToken.Literal, 0, 64)
 	if err != nil {
-		panic(ParserError{msg: fmt.Sprintf("could not parse %q as intger", p.currentToken.Literal), errorToken: p.currentToken})
+		p.errorf(p.currentToken.Pos, "could not parse %q as intger", p.currentToken.Literal)
+		return &ast.Integer{Token: p.currentToken, Value: 0}
 	}
 
 	return &ast.Integer{Token: p.currentToken, Value: value}
@@ -291,7 +498,8 @@ func (p *Parser) parseBoolean() ast.Expression {
 	} else if p.currentToken.Type == token.FALSE {
 		value = false
 	} else {
-		panic(ParserError{msg: fmt.Sprintf("could not parse %q as boolean", p.currentToken.Literal), errorToken: p.currentToken})
+		p.errorf(p.currentToken.Pos, "could not parse %q as boolean", p.currentToken.Literal)
+		return &ast.Boolean{Token: p.currentToken, Value: false}
 	}
 
 	return &ast.Boolean{Token: p.currentToken, Value: value}
@@ -302,9 +510,7 @@ func (p *Parser) parseString() ast.Expression {
 }
 
 func (p *Parser) parsePrefix() ast.Expression {
-	if p.tracing {
-		defer un(trace(p, "Prefix"))
-	}
+	defer p.trace("Prefix")()
 
 	prefix := &ast.PrefixExpression{Token: p.currentToken, Operator: p.currentToken.Literal}
 
@@ -321,9 +527,7 @@ func (p *Parser) parsePrefix() ast.Expression {
 
 // when called p.currentToken must point to a infix operator
 func (p *Parser) parseInfix(left ast.Expression) ast.Expression {
-	if p.tracing {
-		defer un(trace(p, "Infix"))
-	}
+	defer p.trace("Infix")()
 
 	infix := &ast.InfixExpression{Token: p.currentToken, Left: left, Operator: p.currentToken.Literal}
 
@@ -338,17 +542,13 @@ func (p *Parser) parseInfix(left ast.Expression) ast.Expression {
 }
 
 func (p *Parser) parsePostfix(left ast.Expression) ast.Expression {
-	if p.tracing {
-		defer un(trace(p, "Postfix"))
-	}
+	defer p.trace("Postfix")()
 
 	return &ast.PostfixExpression{Token: p.currentToken, Left: left, Operator: p.currentToken.Literal}
 }
 
 func (p *Parser) parseGroupedExpression() ast.Expression {
-	if p.tracing {
-		defer un(trace(p, "GroupedExpression"))
-	}
+	defer p.trace("GroupedExpression")()
 
 	p.assertCurrentTokenType(token.LPAREN)
 
@@ -360,14 +560,14 @@ func (p *Parser) parseGroupedExpression() ast.Expression {
 }
 
 func (p *Parser) parseIfExpression() ast.Expression {
-	if p.tracing {
-		defer un(trace(p, "IfExpression"))
-	}
+	defer p.trace("IfExpression")()
 
 	ifExpress := &ast.IfExpression{Token: p.currentToken}
 
 	if !p.currentTokenTypeIs(token.IF) {
-		panic(ParserError{msg: fmt.Sprintf("expectd token type is %q, got %q", token.IF, p.currentToken.Type), errorToken: p.currentToken})
+		p.errorf(p.currentToken.Pos, "expectd token type is %q, got %q", token.IF, p.currentToken.Type)
+		p.sync()
+		return ifExpress
 	}
 
 	p.assertNextTokenType(token.LPAREN)
@@ -395,14 +595,15 @@ func (p *Parser) parseIfExpression() ast.Expression {
 }
 
 func (p *Parser) parseBlockExpression() *ast.BlockExpression {
-	if p.tracing {
-		defer un(trace(p, "BlockExpression"))
-	}
+	defer p.trace("BlockExpression")()
 
 	block := &ast.BlockExpression{Token: p.currentToken}
 
 	p.assertCurrentTokenType(token.LBRACE)
 
+	p.blockDepth++
+	defer func() { p.blockDepth-- }()
+
 	for !p.currentTokenTypeIs(token.RBRACE) && !p.currentTokenTypeIs(token.EOF) {
 		if statement := p.parseStatement(); statement != nil {
 			block.Statements = append(block.Statements, statement)
@@ -412,16 +613,14 @@ func (p *Parser) parseBlockExpression() *ast.BlockExpression {
 	}
 
 	if !p.currentTokenTypeIs(token.RBRACE) {
-		panic(ParserError{msg: fmt.Sprintf("expectd token type is %q, got %q", token.RBRACE, p.currentToken.Type), errorToken: p.currentToken})
+		p.errorf(p.currentToken.Pos, "expectd token type is %q, got %q", token.RBRACE, p.currentToken.Type)
 	}
 
 	return block
 }
 
 func (p *Parser) parseFunction() ast.Expression {
-	if p.tracing {
-		defer un(trace(p, "Function"))
-	}
+	defer p.trace("Function")()
 
 	function := &ast.FunctionExpression{Token: p.currentToken}
 
@@ -443,9 +642,7 @@ func (p *Parser) parseFunction() ast.Expression {
 }
 
 func (p *Parser) parseArrayLiteral() ast.Expression {
-	if p.tracing {
-		defer un(trace(p, "ArrayLiteral"))
-	}
+	defer p.trace("ArrayLiteral")()
 
 	array := &ast.ArrayLiteral{Token: p.currentToken}
 
@@ -464,15 +661,13 @@ func (p *Parser) parseArrayLiteral() ast.Expression {
 	}
 
 	if p.currentToken.Type != token.RBRACKET {
-		panic(ParserError{msg: fmt.Sprintf("expectd token type is %q, got %q", token.RBRACKET, p.currentToken.Type), errorToken: p.currentToken})
+		p.errorf(p.currentToken.Pos, "expectd token type is %q, got %q", token.RBRACKET, p.currentToken.Type)
 	}
 	return array
 }
 
 func (p *Parser) parseParameters() []*ast.Identifier {
-	if p.tracing {
-		defer un(trace(p, "Parameters"))
-	}
+	defer p.trace("Parameters")()
 
 	p.nextToken()
 	params := []*ast.Identifier{}
@@ -486,16 +681,14 @@ func (p *Parser) parseParameters() []*ast.Identifier {
 	}
 
 	if !p.currentTokenTypeIs(token.RPAREN) {
-		panic(ParserError{msg: fmt.Sprintf("expectd token type is %q, got %q", token.RPAREN, p.currentToken.Type), errorToken: p.currentToken})
+		p.errorf(p.currentToken.Pos, "expectd token type is %q, got %q", token.RPAREN, p.currentToken.Type)
 	}
 
 	return params
 }
 
 func (p *Parser) parseHashLiteral() ast.Expression {
-	if p.tracing {
-		defer un(trace(p, "HashLiteral"))
-	}
+	defer p.trace("HashLiteral")()
 
 	hash := &ast.HashLiteral{Token: p.currentToken, Pair: make(map[ast.Expression]ast.Expression)}
 
@@ -519,22 +712,20 @@ func (p *Parser) parseHashLiteral() ast.Expression {
 	}
 
 	if p.currentToken.Type != token.RBRACE {
-		panic(ParserError{msg: fmt.Sprintf("expectd token type is %q, got %q", token.RBRACE, p.currentToken.Type), errorToken: p.currentToken})
+		p.errorf(p.currentToken.Pos, "expectd token type is %q, got %q", token.RBRACE, p.currentToken.Type)
 	}
 	return hash
 }
 
 func (p *Parser) parseCallExpression(fun ast.Expression) ast.Expression {
-	if p.tracing {
-		defer un(trace(p, "CallExpression"))
-	}
+	defer p.trace("CallExpression")()
 
 	call := &ast.CallExpression{Token: p.currentToken, Function: fun}
 
 	p.assertCurrentTokenType(token.LPAREN)
 
 	args := []ast.Expression{}
-	for p.currentToken.Type != token.RPAREN {
+	for p.currentToken.Type != token.RPAREN && p.currentToken.Type != token.EOF {
 		if p.currentToken.Type != token.COMMA {
 			arg := p.parseExpression(token.LOWEST_PRECEDENCE)
 
@@ -542,14 +733,17 @@ func (p *Parser) parseCallExpression(fun ast.Expression) ast.Expression {
 		}
 		p.nextToken()
 	}
+
+	if p.currentToken.Type != token.RPAREN {
+		p.errorf(p.currentToken.Pos, "expectd token type is %q, got %q", token.RPAREN, p.currentToken.Type)
+	}
+
 	call.Arguments = args
 	return call
 }
 
 func (p *Parser) parseIndexExpression(ex ast.Expression) ast.Expression {
-	if p.tracing {
-		defer un(trace(p, "IndexExpression"))
-	}
+	defer p.trace("IndexExpression")()
 
 	indexEx := &ast.InfixExpression{Token: p.currentToken, Left: ex, Operator: p.currentToken.Literal}
 
@@ -562,16 +756,25 @@ func (p *Parser) parseIndexExpression(ex ast.Expression) ast.Expression {
 	return indexEx
 }
 
-func (p *Parser) ParseProgram() (program *ast.Program, err error) {
-	if p.tracing {
-		defer un(trace(p, "Program"))
-	}
+// ParseProgram parses the whole input and returns the resulting AST
+// together with every error found along the way. A non-empty ErrorList
+// does not necessarily mean program is nil: parsing recovers from most
+// errors and keeps going, so callers that want strict behavior should
+// check errs.Err() themselves.
+func (p *Parser) ParseProgram() (program *ast.Program, errs ErrorList) {
+	defer p.trace("Program")()
+
+	program = &ast.Program{}
 
 	defer func() {
 		if r := recover(); r != nil {
-			err = r.(error)
-			program = nil
+			if _, ok := r.(bailout); !ok {
+				panic(r)
+			}
 		}
+
+		p.errors.Sort()
+		errs = p.errors
 	}()
 
 	if !p.initialized {
@@ -580,8 +783,6 @@ func (p *Parser) ParseProgram() (program *ast.Program, err error) {
 		p.initialized = true
 	}
 
-	program = &ast.Program{}
-
 	for !p.currentTokenTypeIs(token.EOF) {
 		if statement := p.parseStatement(); statement != nil {
 			program.Statements = append(program.Statements, statement)
@@ -590,5 +791,5 @@ func (p *Parser) ParseProgram() (program *ast.Program, err error) {
 		p.nextToken()
 	}
 
-	return program, nil
+	return
 }
@@ -2,20 +2,34 @@ package repl
 
 import (
 	"bufio"
+	"bytes"
 	"compiler"
+	"encoding/binary"
 	"evaluator"
 	"fmt"
 	"io"
 	"object"
+	"os"
 	"parser"
+	"strings"
+	"token"
 	"vm"
 )
 
 const PROMPT = ">>"
 
+const saveCommandPrefix = ":save "
+const loadCommandPrefix = ":load "
+
+// replFilename is used as the source name for every line a REPL reads, so
+// parse errors read like "<repl>:1:5: ..." rather than naming a file that
+// doesn't exist.
+const replFilename = "<repl>"
+
 func StartWithInterpreter(in io.Reader, out io.Writer) {
 	scanner := bufio.NewScanner(in)
 	env := object.NewEnvironment()
+	fset := token.NewFileSet()
 	for {
 		fmt.Printf(PROMPT)
 		scanned := scanner.Scan()
@@ -24,16 +38,16 @@ func StartWithInterpreter(in io.Reader, out io.Writer) {
 		}
 
 		line := scanner.Text()
-		parser := parser.New(line)
-		program, err := parser.ParseProgram()
-		if err != nil {
+		parser := parser.NewWithMode(fset, replFilename, line, 0, os.Stdout)
+		program, errs := parser.ParseProgram()
+		if err := errs.Err(); err != nil {
 			fmt.Printf("parse program failed: %s", err)
 			continue
 		}
 
 		obj := evaluator.Eval(program, env)
 		if evaluator.IsError(obj) {
-			fmt.Printf("evaluate program failed: %s", err)
+			fmt.Printf("evaluate program failed: %s", obj.Inspect())
 			continue
 		}
 
@@ -43,6 +57,7 @@ func StartWithInterpreter(in io.Reader, out io.Writer) {
 
 func StartWithCompiler(in io.Reader, out io.Writer) {
 	scanner := bufio.NewScanner(in)
+	fset := token.NewFileSet()
 
 	constants := []object.Object{}
 	globalSymbalTable := compiler.NewSymbolTable()
@@ -56,23 +71,40 @@ func StartWithCompiler(in io.Reader, out io.Writer) {
 		}
 
 		line := scanner.Text()
-		parser := parser.New(line)
-		program, err := parser.ParseProgram()
-		if err != nil {
+
+		if path, ok := cutPrefix(line, saveCommandPrefix); ok {
+			if err := saveSession(path, constants, globalSymbalTable, globals); err != nil {
+				fmt.Fprintf(out, "save failed: %s\n", err)
+			}
+			continue
+		}
+
+		if path, ok := cutPrefix(line, loadCommandPrefix); ok {
+			loadedConstants, loadedGlobals, err := loadSession(path, globalSymbalTable)
+			if err != nil {
+				fmt.Fprintf(out, "load failed: %s\n", err)
+				continue
+			}
+			constants = loadedConstants
+			globals = loadedGlobals
+			continue
+		}
+
+		parser := parser.NewWithMode(fset, replFilename, line, 0, os.Stdout)
+		program, errs := parser.ParseProgram()
+		if err := errs.Err(); err != nil {
 			fmt.Fprintf(out, "parse program failed: %s", err)
 			continue
 		}
 
 		c := compiler.NewWithStates(constants, globalSymbalTable)
-		err = c.Compile(program)
-		if err != nil {
+		if err := c.Compile(program); err != nil {
 			fmt.Fprintf(out, "compile program failed: %s", err)
 			continue
 		}
 
 		vm := vm.NewWithGlobals(c.Bytecode(), globals)
-		err = vm.Run()
-		if err != nil {
+		if err := vm.Run(); err != nil {
 			fmt.Fprintf(out, "vm run program failed: %s", err)
 			continue
 		}
@@ -82,3 +114,133 @@ func StartWithCompiler(in io.Reader, out io.Writer) {
 		io.WriteString(out, "\n")
 	}
 }
+
+// cutPrefix returns the rest of line after prefix, trimmed, plus true if
+// line starts with prefix.
+func cutPrefix(line, prefix string) (string, bool) {
+	if !strings.HasPrefix(line, prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(line, prefix)), true
+}
+
+// sessionMagic identifies a file written by saveSession, distinct from the
+// "GRLA" bytecode magic since a session bundles bytecode, the global
+// symbol table, and the current global values together.
+const sessionMagic = "GRLS"
+
+// saveSession writes the current compiled constants, symbol table, and
+// global values to path so a later :load can restore them exactly. The
+// instruction stream itself isn't meaningful outside of the expression
+// that produced it, so only the constant pool, the symbol table and the
+// globals persist.
+//
+// globals is preallocated to vm.GlobalSize, almost all of it unused, so
+// only the defined prefix (per symbolTable.NumDefinitions) is marshaled.
+func saveSession(path string, constants []object.Object, symbolTable *compiler.SymbolTable, globals []object.Object) error {
+	constantsBlob, err := (&compiler.Bytecode{Constants: constants}).MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	symbolsBlob, err := symbolTable.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	definedGlobals := globals[:symbolTable.NumDefinitions()]
+	globalsBlob, err := (&compiler.Bytecode{Constants: definedGlobals}).MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(sessionMagic); err != nil {
+		return err
+	}
+	for _, blob := range [][]byte{constantsBlob, symbolsBlob, globalsBlob} {
+		if err := writeLengthPrefixed(file, blob); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadSession reads a file written by saveSession, restores its symbols
+// into symbolTable, and returns its constants and globals, so the REPL's
+// next compile picks up right where the saved session left off.
+func loadSession(path string, symbolTable *compiler.SymbolTable) ([]object.Object, []object.Object, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	buf := bytes.NewReader(data)
+
+	magic := make([]byte, len(sessionMagic))
+	if _, err := buf.Read(magic); err != nil {
+		return nil, nil, err
+	}
+	if string(magic) != sessionMagic {
+		return nil, nil, fmt.Errorf("not a gorilla session file: bad magic %q", magic)
+	}
+
+	constantsBlob, err := readLengthPrefixed(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	symbolsBlob, err := readLengthPrefixed(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	globalsBlob, err := readLengthPrefixed(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var constantsBytecode compiler.Bytecode
+	if err := constantsBytecode.UnmarshalBinary(constantsBlob); err != nil {
+		return nil, nil, err
+	}
+
+	if err := symbolTable.UnmarshalBinary(symbolsBlob); err != nil {
+		return nil, nil, err
+	}
+
+	var globalsBytecode compiler.Bytecode
+	if err := globalsBytecode.UnmarshalBinary(globalsBlob); err != nil {
+		return nil, nil, err
+	}
+
+	globals := make([]object.Object, vm.GlobalSize)
+	copy(globals, globalsBytecode.Constants)
+
+	return constantsBytecode.Constants, globals, nil
+}
+
+func writeLengthPrefixed(w io.Writer, data []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readLengthPrefixed(r *bytes.Reader) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,66 @@
+package repl
+
+import (
+	"compiler"
+	"object"
+	"os"
+	"parser"
+	"path/filepath"
+	"testing"
+	"token"
+	"vm"
+)
+
+// TestSaveLoadSessionRoundTrip drives the :save/:load pair directly: compile
+// and run a few statements that define globals of different types, save the
+// session, load it back into a fresh symbol table, and check every global
+// comes back with the same value at the same index.
+func TestSaveLoadSessionRoundTrip(t *testing.T) {
+	fset := token.NewFileSet()
+	input := `let a = 5; let b = "gorilla"; let c = [1, 2, 3]; let d = {"x": 1};`
+
+	p := parser.NewWithMode(fset, replFilename, input, 0, os.Stdout)
+	program, errs := p.ParseProgram()
+	if err := errs.Err(); err != nil {
+		t.Fatalf("parse program failed: %s", err)
+	}
+
+	symbolTable := compiler.NewSymbolTable()
+	c := compiler.NewWithStates([]object.Object{}, symbolTable)
+	if err := c.Compile(program); err != nil {
+		t.Fatalf("compile program failed: %s", err)
+	}
+
+	globals := make([]object.Object, vm.GlobalSize)
+	machine := vm.NewWithGlobals(c.Bytecode(), globals)
+	if err := machine.Run(); err != nil {
+		t.Fatalf("vm run failed: %s", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "session.grls")
+	if err := saveSession(path, c.Bytecode().Constants, symbolTable, globals); err != nil {
+		t.Fatalf("saveSession failed: %s", err)
+	}
+
+	restoredTable := compiler.NewSymbolTable()
+	_, restoredGlobals, err := loadSession(path, restoredTable)
+	if err != nil {
+		t.Fatalf("loadSession failed: %s", err)
+	}
+
+	for _, name := range []string{"a", "b", "c", "d"} {
+		sym, ok := restoredTable.Resolve(name)
+		if !ok {
+			t.Fatalf("restored symbol table missing %q", name)
+		}
+
+		want := globals[sym.Index]
+		got := restoredGlobals[sym.Index]
+		if got == nil {
+			t.Fatalf("restored global %q is nil", name)
+		}
+		if got.Inspect() != want.Inspect() {
+			t.Errorf("global %q not equal. want=%s, got=%s", name, want.Inspect(), got.Inspect())
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package token
+
+// Pos is an offset into a FileSet's combined address space. The zero
+// value, NoPos, means "no position"; any other value identifies a byte
+// offset inside exactly one File registered with the FileSet that
+// produced it. Tokens carry a Pos instead of an already-resolved
+// Position so that resolving line/column information (which requires
+// scanning a file's recorded line starts) only happens when an error
+// actually needs to be reported.
+type Pos int
+
+// NoPos is the zero Pos. FileSet.Position(NoPos) returns the zero
+// Position.
+const NoPos Pos = 0
+
+// File tracks the line boundaries of a single source file within a
+// FileSet's combined offset space, so Pos values belonging to it can be
+// resolved back to a line and column.
+type File struct {
+	name  string
+	base  int
+	size  int
+	lines []int // byte offset of the start of each line; lines[0] == 0
+}
+
+// Name returns the name the file was registered with.
+func (f *File) Name() string { return f.name }
+
+// Base returns the Pos of the file's first byte.
+func (f *File) Base() int { return f.base }
+
+// Size returns the file's size in bytes.
+func (f *File) Size() int { return f.size }
+
+// AddLine records that a new line starts at offset, a byte offset
+// relative to the start of the file. Callers must add offsets in
+// increasing order; out-of-order or out-of-range offsets are ignored.
+func (f *File) AddLine(offset int) {
+	if len(f.lines) == 0 && offset != 0 {
+		f.lines = append(f.lines, 0)
+	}
+
+	if n := len(f.lines); offset > 0 && offset < f.size && (n == 0 || f.lines[n-1] < offset) {
+		f.lines = append(f.lines, offset)
+	}
+}
+
+func (f *File) position(p Pos) Position {
+	offset := int(p) - f.base
+	line, column := 1, offset+1
+
+	for i := len(f.lines) - 1; i >= 0; i-- {
+		if f.lines[i] <= offset {
+			line = i + 1
+			column = offset - f.lines[i] + 1
+			break
+		}
+	}
+
+	return Position{Filename: f.name, Line: line, Column: column}
+}
+
+// FileSet is a collection of source files, each given a disjoint range
+// within one growing offset space so a single Pos value unambiguously
+// identifies both a file and an offset inside it. Modeled on
+// go/token.FileSet.
+type FileSet struct {
+	base  int
+	files []*File
+}
+
+// NewFileSet creates an empty FileSet. The first file added starts at
+// offset 1, so NoPos never collides with a real position.
+func NewFileSet() *FileSet {
+	return &FileSet{base: 1}
+}
+
+// AddFile registers a new file of size bytes and returns it. If base is
+// negative, the file is placed right after whatever is already
+// registered; otherwise base fixes its starting Pos.
+func (s *FileSet) AddFile(filename string, base, size int) *File {
+	if base < 0 {
+		base = s.base
+	}
+
+	f := &File{name: filename, base: base, size: size}
+	s.files = append(s.files, f)
+
+	// Leave one Pos of headroom past the end of the file so an EOF token
+	// positioned just past the last byte still resolves to this file.
+	s.base = base + size + 1
+	return f
+}
+
+// Position resolves p to a human-readable Filename/Line/Column. It
+// returns the zero Position if p does not belong to any file in s.
+func (s *FileSet) Position(p Pos) Position {
+	for _, f := range s.files {
+		if int(p) >= f.base && int(p) <= f.base+f.size {
+			return f.position(p)
+		}
+	}
+
+	return Position{}
+}
@@ -0,0 +1,26 @@
+package vm
+
+import (
+	"code"
+	"object"
+)
+
+// Frame is a single call frame on the VM's call stack: the compiled
+// function currently executing, its captured free variables (if it was
+// invoked as a closure), an instruction pointer into its own instructions,
+// and the base pointer marking where its locals start on the operand
+// stack.
+type Frame struct {
+	fn            *object.CompiledFunction
+	freeVariables []object.Object
+	ip            int
+	basePointer   int
+}
+
+func NewFrame(fn *object.CompiledFunction, free []object.Object, basePointer int) *Frame {
+	return &Frame{fn: fn, freeVariables: free, ip: -1, basePointer: basePointer}
+}
+
+func (f *Frame) Instructions() code.Instructions {
+	return f.fn.Instructions
+}
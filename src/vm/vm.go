@@ -8,24 +8,61 @@ import (
 )
 
 const StackSize = 2048
+const GlobalSize = 65536
+const MaxFrames = 1024
+
+var True = &object.Boolean{Value: true}
+var False = &object.Boolean{Value: false}
+var Null = &object.Null{}
 
 type VM struct {
-	instructions code.Instructions
-	constants    []object.Object
+	constants []object.Object
 
 	stack []object.Object
 	sp    int
+
+	globals []object.Object
+
+	frames     []*Frame
+	frameIndex int
 }
 
 func New(bytecode *compiler.Bytecode) *VM {
+	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions}
+
+	frames := make([]*Frame, MaxFrames)
+	frames[0] = NewFrame(mainFn, nil, 0)
+
 	return &VM{
-		instructions: bytecode.Instructions,
-		constants:    bytecode.Constants,
-		stack:        make([]object.Object, StackSize),
-		sp:           -1,
+		constants:  bytecode.Constants,
+		stack:      make([]object.Object, StackSize),
+		sp:         -1,
+		globals:    make([]object.Object, GlobalSize),
+		frames:     frames,
+		frameIndex: 1,
 	}
 }
 
+func NewWithGlobals(bytecode *compiler.Bytecode, globals []object.Object) *VM {
+	v := New(bytecode)
+	v.globals = globals
+	return v
+}
+
+func (v *VM) currentFrame() *Frame {
+	return v.frames[v.frameIndex-1]
+}
+
+func (v *VM) pushFrame(f *Frame) {
+	v.frames[v.frameIndex] = f
+	v.frameIndex++
+}
+
+func (v *VM) popFrame() *Frame {
+	v.frameIndex--
+	return v.frames[v.frameIndex]
+}
+
 func (v *VM) pushStack(o object.Object) error {
 	if v.sp >= len(v.stack) {
 		return fmt.Errorf("Stack full")
@@ -54,22 +91,429 @@ func (v *VM) StackTop() object.Object {
 	return v.stack[v.sp]
 }
 
+// StackLastTop returns the value popStack most recently returned, i.e. the
+// value left just above the current stack pointer. This is what the REPL
+// prints: once Run finishes, the result of the last expression statement
+// has already been popped off the stack, so StackTop would be nil.
+func (v *VM) StackLastTop() object.Object {
+	return v.stack[v.sp+1]
+}
+
 func (v *VM) Run() error {
-	for ip := 0; ip < len(v.instructions); ip++ {
-		c := code.OpCode(v.instructions[ip])
+	for v.currentFrame().ip < len(v.currentFrame().Instructions())-1 {
+		v.currentFrame().ip++
+
+		ip := v.currentFrame().ip
+		ins := v.currentFrame().Instructions()
+		c := code.OpCode(ins[ip])
 
 		switch c {
 		case code.OpConstant:
-			index := code.ReadUint16(v.instructions[ip+1:])
-			ip += 2
+			index := code.ReadUint16(ins[ip+1:])
+			v.currentFrame().ip += 2
+
+			if err := v.pushStack(v.constants[index]); err != nil {
+				return err
+			}
+
+		case code.OpPop:
+			v.popStack()
+
+		case code.OpTrue:
+			if err := v.pushStack(True); err != nil {
+				return err
+			}
+
+		case code.OpFalse:
+			if err := v.pushStack(False); err != nil {
+				return err
+			}
+
+		case code.OpNull:
+			if err := v.pushStack(Null); err != nil {
+				return err
+			}
+
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
+			if err := v.executeBinaryOperation(c); err != nil {
+				return err
+			}
+
+		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan:
+			if err := v.executeComparison(c); err != nil {
+				return err
+			}
+
+		case code.OpBang:
+			if err := v.executeBangOperator(); err != nil {
+				return err
+			}
+
+		case code.OpMinus:
+			if err := v.executeMinusOperator(); err != nil {
+				return err
+			}
+
+		case code.OpJump:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			v.currentFrame().ip = pos - 1
+
+		case code.OpJumpNotTruthy:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			v.currentFrame().ip += 2
+
+			condition := v.popStack()
+			if !isTruthy(condition) {
+				v.currentFrame().ip = pos - 1
+			}
+
+		case code.OpSetGlobal:
+			index := code.ReadUint16(ins[ip+1:])
+			v.currentFrame().ip += 2
+			v.globals[index] = v.popStack()
 
-			fmt.Printf("constant index %d", index)
-			err := v.pushStack(v.constants[index])
+		case code.OpGetGlobal:
+			index := code.ReadUint16(ins[ip+1:])
+			v.currentFrame().ip += 2
+
+			if err := v.pushStack(v.globals[index]); err != nil {
+				return err
+			}
+
+		case code.OpSetLocal:
+			index := code.ReadUint8(ins[ip+1:])
+			v.currentFrame().ip += 1
+
+			frame := v.currentFrame()
+			v.stack[frame.basePointer+int(index)] = v.popStack()
+
+		case code.OpGetLocal:
+			index := code.ReadUint8(ins[ip+1:])
+			v.currentFrame().ip += 1
+
+			frame := v.currentFrame()
+			if err := v.pushStack(v.stack[frame.basePointer+int(index)]); err != nil {
+				return err
+			}
+
+		case code.OpGetFree:
+			index := code.ReadUint8(ins[ip+1:])
+			v.currentFrame().ip += 1
+
+			freeVariables := v.currentFrame().freeVariables
+			if err := v.pushStack(freeVariables[index]); err != nil {
+				return err
+			}
+
+		case code.OpArray:
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			v.currentFrame().ip += 2
+
+			array := v.buildArray(v.sp-numElements+1, v.sp+1)
+			v.sp = v.sp - numElements
+
+			if err := v.pushStack(array); err != nil {
+				return err
+			}
+
+		case code.OpHash:
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			v.currentFrame().ip += 2
+
+			hash, err := v.buildHash(v.sp-numElements+1, v.sp+1)
 			if err != nil {
 				return err
 			}
+			v.sp = v.sp - numElements
+
+			if err := v.pushStack(hash); err != nil {
+				return err
+			}
+
+		case code.OpIndex:
+			index := v.popStack()
+			left := v.popStack()
+
+			if err := v.executeIndexExpression(left, index); err != nil {
+				return err
+			}
+
+		case code.OpClosure:
+			constIndex := code.ReadUint16(ins[ip+1:])
+			numFree := code.ReadUint8(ins[ip+3:])
+			v.currentFrame().ip += 3
+
+			if err := v.pushClosure(int(constIndex), int(numFree)); err != nil {
+				return err
+			}
+
+		case code.OpCall:
+			numArgs := code.ReadUint8(ins[ip+1:])
+			v.currentFrame().ip += 1
+
+			if err := v.callFunction(int(numArgs)); err != nil {
+				return err
+			}
+
+		case code.OpReturnValue:
+			returnValue := v.popStack()
+
+			frame := v.popFrame()
+			v.sp = frame.basePointer - 1
+
+			if err := v.pushStack(returnValue); err != nil {
+				return err
+			}
+
+		case code.OpReturn:
+			frame := v.popFrame()
+			v.sp = frame.basePointer - 1
+
+			if err := v.pushStack(Null); err != nil {
+				return err
+			}
+
+		default:
+			return fmt.Errorf("unknown opcode %d", c)
 		}
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+func (v *VM) executeBinaryOperation(op code.OpCode) error {
+	right := v.popStack()
+	left := v.popStack()
+
+	leftInt, leftOk := left.(*object.Integer)
+	rightInt, rightOk := right.(*object.Integer)
+
+	if leftOk && rightOk {
+		return v.executeBinaryIntegerOperation(op, leftInt, rightInt)
+	}
+
+	leftStr, leftOk := left.(*object.String)
+	rightStr, rightOk := right.(*object.String)
+
+	if leftOk && rightOk {
+		return v.executeBinaryStringOperation(op, leftStr, rightStr)
+	}
+
+	return fmt.Errorf("unsupported types for binary operation: %s %s", left.Type(), right.Type())
+}
+
+func (v *VM) executeBinaryIntegerOperation(op code.OpCode, left, right *object.Integer) error {
+	var result int64
+
+	switch op {
+	case code.OpAdd:
+		result = left.Value + right.Value
+	case code.OpSub:
+		result = left.Value - right.Value
+	case code.OpMul:
+		result = left.Value * right.Value
+	case code.OpDiv:
+		if right.Value == 0 {
+			return fmt.Errorf("division by zero")
+		}
+		result = left.Value / right.Value
+	default:
+		return fmt.Errorf("unknown integer operator: %d", op)
+	}
+
+	return v.pushStack(&object.Integer{Value: result})
+}
+
+func (v *VM) executeBinaryStringOperation(op code.OpCode, left, right *object.String) error {
+	if op != code.OpAdd {
+		return fmt.Errorf("unknown string operator: %d", op)
+	}
+
+	return v.pushStack(&object.String{Value: left.Value + right.Value})
+}
+
+func (v *VM) executeComparison(op code.OpCode) error {
+	right := v.popStack()
+	left := v.popStack()
+
+	leftInt, leftOk := left.(*object.Integer)
+	rightInt, rightOk := right.(*object.Integer)
+
+	if leftOk && rightOk {
+		return v.executeIntegerComparison(op, leftInt, rightInt)
+	}
+
+	switch op {
+	case code.OpEqual:
+		return v.pushStack(nativeBoolToBooleanObject(left == right))
+	case code.OpNotEqual:
+		return v.pushStack(nativeBoolToBooleanObject(left != right))
+	default:
+		return fmt.Errorf("unknown operator: %d (%s %s)", op, left.Type(), right.Type())
+	}
+}
+
+func (v *VM) executeIntegerComparison(op code.OpCode, left, right *object.Integer) error {
+	switch op {
+	case code.OpEqual:
+		return v.pushStack(nativeBoolToBooleanObject(left.Value == right.Value))
+	case code.OpNotEqual:
+		return v.pushStack(nativeBoolToBooleanObject(left.Value != right.Value))
+	case code.OpGreaterThan:
+		return v.pushStack(nativeBoolToBooleanObject(left.Value > right.Value))
+	default:
+		return fmt.Errorf("unknown operator: %d", op)
+	}
+}
+
+func (v *VM) executeBangOperator() error {
+	operand := v.popStack()
+
+	switch operand {
+	case True:
+		return v.pushStack(False)
+	case False:
+		return v.pushStack(True)
+	case Null:
+		return v.pushStack(True)
+	default:
+		return v.pushStack(False)
+	}
+}
+
+func (v *VM) executeMinusOperator() error {
+	operand := v.popStack()
+
+	value, ok := operand.(*object.Integer)
+	if !ok {
+		return fmt.Errorf("unsupported type for negation: %s", operand.Type())
+	}
+
+	return v.pushStack(&object.Integer{Value: -value.Value})
+}
+
+func (v *VM) buildArray(startIndex, endIndex int) object.Object {
+	elements := make([]object.Object, endIndex-startIndex)
+
+	for i := startIndex; i < endIndex; i++ {
+		elements[i-startIndex] = v.stack[i]
+	}
+
+	return &object.Array{Elements: elements}
+}
+
+func (v *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
+	pairs := make(map[object.HashKey]object.HashPair)
+
+	for i := startIndex; i < endIndex; i += 2 {
+		key := v.stack[i]
+		value := v.stack[i+1]
+
+		hashKey, ok := key.(object.Hashable)
+		if !ok {
+			return nil, fmt.Errorf("unusable as hash key: %s", key.Type())
+		}
+
+		pairs[hashKey.HashKey()] = object.HashPair{Key: key, Value: value}
+	}
+
+	return &object.Hash{Pairs: pairs}, nil
+}
+
+func (v *VM) executeIndexExpression(left, index object.Object) error {
+	switch {
+	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
+		return v.executeArrayIndex(left, index)
+	case left.Type() == object.HASH_OBJ:
+		return v.executeHashIndex(left, index)
+	default:
+		return fmt.Errorf("index operator not supported: %s", left.Type())
+	}
+}
+
+func (v *VM) executeArrayIndex(array, index object.Object) error {
+	arrayObject := array.(*object.Array)
+	i := index.(*object.Integer).Value
+	max := int64(len(arrayObject.Elements) - 1)
+
+	if i < 0 || i > max {
+		return v.pushStack(Null)
+	}
+
+	return v.pushStack(arrayObject.Elements[i])
+}
+
+func (v *VM) executeHashIndex(hash, index object.Object) error {
+	hashObject := hash.(*object.Hash)
+
+	key, ok := index.(object.Hashable)
+	if !ok {
+		return fmt.Errorf("unusable as hash key: %s", index.Type())
+	}
+
+	pair, ok := hashObject.Pairs[key.HashKey()]
+	if !ok {
+		return v.pushStack(Null)
+	}
+
+	return v.pushStack(pair.Value)
+}
+
+func (v *VM) pushClosure(constIndex, numFree int) error {
+	constant := v.constants[constIndex]
+
+	fn, ok := constant.(*object.CompiledFunction)
+	if !ok {
+		return fmt.Errorf("not a function: %+v", constant)
+	}
+
+	free := make([]object.Object, numFree)
+	for i := 0; i < numFree; i++ {
+		free[i] = v.stack[v.sp-numFree+1+i]
+	}
+	v.sp = v.sp - numFree
+
+	return v.pushStack(&object.Closure{Fn: fn, Free: free})
+}
+
+func (v *VM) callFunction(numArgs int) error {
+	callee := v.stack[v.sp-numArgs]
+
+	switch callee := callee.(type) {
+	case *object.Closure:
+		return v.callClosure(callee, numArgs)
+	default:
+		return fmt.Errorf("calling non-function and non-built-in")
+	}
+}
+
+func (v *VM) callClosure(cl *object.Closure, numArgs int) error {
+	if numArgs != cl.Fn.NumParameters {
+		return fmt.Errorf("wrong number of arguments: want=%d, got=%d",
+			cl.Fn.NumParameters, numArgs)
+	}
+
+	frame := NewFrame(cl.Fn, cl.Free, v.sp-numArgs+1)
+	v.pushFrame(frame)
+	v.sp = frame.basePointer + cl.Fn.NumLocals - 1
+
+	return nil
+}
+
+func isTruthy(obj object.Object) bool {
+	switch obj := obj.(type) {
+	case *object.Boolean:
+		return obj.Value
+	case *object.Null:
+		return false
+	default:
+		return true
+	}
+}
+
+func nativeBoolToBooleanObject(input bool) *object.Boolean {
+	if input {
+		return True
+	}
+	return False
+}